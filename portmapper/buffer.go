@@ -0,0 +1,30 @@
+package portmapper
+
+import "sync"
+
+// bufferPool hands out fixed-size datagram buffers backed by a sync.Pool,
+// so the send and receive paths reuse allocations across packets instead
+// of allocating (and garbage-collecting) one per datagram.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// newBufferPool returns a bufferPool whose buffers are size bytes, large
+// enough to hold one datagram without truncation. metrics.BufferAlloc is
+// called whenever the pool has to allocate a fresh buffer.
+func newBufferPool(size int, metrics Metrics) (bp *bufferPool) {
+	bp = &bufferPool{}
+	bp.pool.New = func() interface{} {
+		metrics.BufferAlloc()
+		return make([]byte, size)
+	}
+	return
+}
+
+func (bp *bufferPool) Get() []byte {
+	return bp.pool.Get().([]byte)
+}
+
+func (bp *bufferPool) Put(buf []byte) {
+	bp.pool.Put(buf)
+}
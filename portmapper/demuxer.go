@@ -0,0 +1,27 @@
+package portmapper
+
+import "net"
+
+// NATMode controls how UdpPortMapper maps client flows onto upstream
+// connections.
+type NATMode int
+
+const (
+	// SymmetricNAT dials a fresh upstream connection per source address,
+	// the historical behaviour of UdpPortMapper.
+	SymmetricNAT NATMode = iota
+	// EndpointIndependent shares a single upstream connection for all
+	// sources dialing the same pm.Dst (full-cone NAT), relying on a
+	// Demuxer to tell replies apart.
+	EndpointIndependent
+)
+
+// Demuxer lets multiple client flows share one upstream UDP connection.
+// Encode is applied to outgoing packets so the upstream side (or a peer
+// speaking the same convention) can tell flows apart, and Decode recovers
+// the originating client address from an incoming packet so the reply can
+// be routed back to the right source.
+type Demuxer interface {
+	Encode(src net.Addr, p []byte) []byte
+	Decode(p []byte) (src net.Addr, payload []byte, err error)
+}
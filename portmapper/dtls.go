@@ -0,0 +1,128 @@
+package portmapper
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/pion/dtls/v2"
+)
+
+// udpFlowConn adapts one UdpMapperConn's client-facing side (the shared
+// listen socket plus the per-flow inbound channel getOrDial already
+// routes packets onto) into a net.Conn, so a DTLS server handshake can be
+// driven off it like any other datagram transport. Read blocks on the
+// first queued UdpPackage, which is what lets the handshake start itself
+// off the flow's first inbound packet rather than needing to be kicked
+// off separately.
+type udpFlowConn struct {
+	umc *UdpMapperConn
+}
+
+func (c *udpFlowConn) Read(b []byte) (n int, err error) {
+	up, ok := <-c.umc.ch
+	if !ok {
+		return 0, io.EOF
+	}
+	n = copy(b, up.buf[0:up.nr])
+	up.Free()
+	return n, nil
+}
+
+func (c *udpFlowConn) Write(b []byte) (n int, err error) {
+	return c.umc.sconn.WriteTo(b, c.umc.addr)
+}
+
+// Close is a no-op: the flow's lifecycle is owned by UdpMapperConn.Close /
+// closeReason, not by whoever holds this adapter.
+func (c *udpFlowConn) Close() error                       { return nil }
+func (c *udpFlowConn) LocalAddr() net.Addr                { return c.umc.sconn.LocalAddr() }
+func (c *udpFlowConn) RemoteAddr() net.Addr               { return c.umc.addr }
+func (c *udpFlowConn) SetDeadline(t time.Time) error      { return nil }
+func (c *udpFlowConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *udpFlowConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// runDTLS replaces the plain SendHandler/RecvHandler pair for a flow whose
+// PortMap has ListenDTLS set: it terminates a DTLS server session against
+// the client over a udpFlowConn, then bridges plaintext to and from the
+// (possibly DialDTLS-originated) upstream dconn.
+func (umc *UdpMapperConn) runDTLS() {
+	clientConn, err := dtls.Server(&udpFlowConn{umc: umc}, umc.pm.ListenDTLS)
+	if err != nil {
+		logger.Error("dtls handshake with %s failed: %s.", umc.addr.String(), err.Error())
+		umc.closeReason("dtls handshake failed")
+		return
+	}
+	go umc.sendHandlerDTLS(clientConn)
+	umc.recvHandlerDTLS(clientConn)
+}
+
+// sendHandlerDTLS is the DTLS analogue of SendHandler: it reads plaintext
+// decrypted off the client's DTLS session and forwards it to dconn.
+func (umc *UdpMapperConn) sendHandlerDTLS(clientConn net.Conn) {
+	defer umc.dconn.Close()
+	buf := umc.pool.Get()
+	defer umc.pool.Put(buf)
+	for {
+		nr, err := clientConn.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				logger.Error("%s", err.Error())
+			}
+			return
+		}
+
+		_, err = umc.dconn.Write(buf[0:nr])
+		switch err {
+		case nil:
+		case io.EOF:
+			return
+		default:
+			logger.Error("%s", err.Error())
+			continue
+		}
+
+		umc.metrics.Packet(DirOut, nr)
+		umc.hooks.OnPacket(DirOut, nr)
+		logger.Debug("udp package sent (dtls) %s <=> %s.", umc.addr.String(), umc.dst)
+	}
+}
+
+// recvHandlerDTLS is the DTLS analogue of RecvHandler: it reads plaintext
+// from dconn and encrypts it onto the client's DTLS session.
+func (umc *UdpMapperConn) recvHandlerDTLS(clientConn net.Conn) {
+	buf := umc.pool.Get()
+	defer umc.pool.Put(buf)
+	defer umc.dconn.Close()
+	for {
+		umc.dconn.SetReadDeadline(time.Now().Add(umc.idleTimeout))
+		nr, err := umc.dconn.Read(buf)
+		switch e := err.(type) {
+		case nil:
+		case net.Error:
+			if e.Timeout() {
+				umc.metrics.IdleTimeout()
+				umc.closeReason("idle timeout")
+				return
+			}
+			logger.Error("%s", err.Error())
+			continue
+		default:
+			if err == io.EOF {
+				return
+			}
+			logger.Error("%s", err.Error())
+			continue
+		}
+
+		_, err = clientConn.Write(buf[0:nr])
+		if err != nil {
+			logger.Error("%s", err.Error())
+			continue
+		}
+
+		umc.metrics.Packet(DirIn, nr)
+		umc.hooks.OnPacket(DirIn, nr)
+		logger.Debug("udp package recved (dtls) %s <=> %s.", umc.addr.String(), umc.dst)
+	}
+}
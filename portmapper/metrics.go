@@ -0,0 +1,190 @@
+package portmapper
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Direction identifies which way a packet travelled through a flow.
+type Direction int
+
+const (
+	DirIn Direction = iota
+	DirOut
+)
+
+// Metrics records counters for portmap flows. NewExpvarMetrics is the
+// default implementation; a Prometheus-backed one can be plugged in via
+// PortMap.Metrics for operators who already run a Prometheus registry.
+type Metrics interface {
+	FlowOpened()
+	FlowClosed()
+	DialFailure()
+	IdleTimeout()
+	Packet(dir Direction, n int)
+	AcceptLatency(d time.Duration)
+	DialLatency(d time.Duration)
+	// Dropped counts a packet that was discarded by a rate or flow limit
+	// instead of opening or forwarding through a UdpMapperConn. reason
+	// identifies which limit fired, e.g. "max_flows", "rate_limit".
+	Dropped(reason string)
+	// BufferAlloc counts a buffer pool miss: a datagram buffer had to be
+	// allocated because none was available for reuse. A high rate next
+	// to FlowOpened suggests the pool is undersized for the traffic.
+	BufferAlloc()
+}
+
+// EventHook lets callers observe individual flow lifecycle events without
+// patching this package. All methods are optional to implement richly;
+// embed noopHooks (or leave the interface partially satisfied by a struct
+// with empty methods) to implement only the ones you care about.
+type EventHook interface {
+	OnFlowOpen(pm PortMap, addr net.Addr)
+	OnFlowClose(pm PortMap, addr net.Addr, reason string)
+	OnPacket(dir Direction, n int)
+}
+
+func metricsOf(pm PortMap) Metrics {
+	if pm.Metrics == nil {
+		return noopMetrics{}
+	}
+	return pm.Metrics
+}
+
+func hooksOf(pm PortMap) EventHook {
+	if pm.Hooks == nil {
+		return noopHooks{}
+	}
+	return pm.Hooks
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) FlowOpened()                   {}
+func (noopMetrics) FlowClosed()                   {}
+func (noopMetrics) DialFailure()                  {}
+func (noopMetrics) IdleTimeout()                  {}
+func (noopMetrics) Packet(dir Direction, n int)   {}
+func (noopMetrics) AcceptLatency(d time.Duration) {}
+func (noopMetrics) DialLatency(d time.Duration)   {}
+func (noopMetrics) Dropped(reason string)         {}
+func (noopMetrics) BufferAlloc()                  {}
+
+type noopHooks struct{}
+
+func (noopHooks) OnFlowOpen(pm PortMap, addr net.Addr)                 {}
+func (noopHooks) OnFlowClose(pm PortMap, addr net.Addr, reason string) {}
+func (noopHooks) OnPacket(dir Direction, n int)                        {}
+
+// ExpvarMetrics is the default Metrics implementation, publishing its
+// counters under expvar so they show up on any process that already
+// exposes /debug/vars.
+type ExpvarMetrics struct {
+	activeFlows  int64
+	bytesIn      int64
+	bytesOut     int64
+	packetsIn    int64
+	packetsOut   int64
+	dialFailures int64
+	idleTimeouts int64
+	dropped      int64
+	bufferAllocs int64
+
+	acceptLatency latencyStats
+	dialLatency   latencyStats
+}
+
+// latencyStats is a bounded count/sum/max summary for a latency series,
+// avoiding the unbounded growth of keeping every observation around.
+type latencyStats struct {
+	count int64
+	sumNs int64
+	maxNs int64
+}
+
+func (s *latencyStats) Observe(d time.Duration) {
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.sumNs, int64(d))
+	for {
+		max := atomic.LoadInt64(&s.maxNs)
+		if int64(d) <= max {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&s.maxNs, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (s *latencyStats) Snapshot() (count, sumNs, maxNs int64) {
+	return atomic.LoadInt64(&s.count), atomic.LoadInt64(&s.sumNs), atomic.LoadInt64(&s.maxNs)
+}
+
+// NewExpvarMetrics creates a Metrics implementation and publishes it under
+// name via expvar.Publish. name must be unique per process.
+func NewExpvarMetrics(name string) (m *ExpvarMetrics) {
+	m = &ExpvarMetrics{}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Snapshot()
+	}))
+	return
+}
+
+// Snapshot returns a point-in-time view of the counters, suitable for
+// JSON encoding.
+func (m *ExpvarMetrics) Snapshot() map[string]int64 {
+	acceptCount, acceptSumNs, acceptMaxNs := m.acceptLatency.Snapshot()
+	dialCount, dialSumNs, dialMaxNs := m.dialLatency.Snapshot()
+	return map[string]int64{
+		"active_flows":          atomic.LoadInt64(&m.activeFlows),
+		"bytes_in":              atomic.LoadInt64(&m.bytesIn),
+		"bytes_out":             atomic.LoadInt64(&m.bytesOut),
+		"packets_in":            atomic.LoadInt64(&m.packetsIn),
+		"packets_out":           atomic.LoadInt64(&m.packetsOut),
+		"dial_failures":         atomic.LoadInt64(&m.dialFailures),
+		"idle_timeouts":         atomic.LoadInt64(&m.idleTimeouts),
+		"dropped":               atomic.LoadInt64(&m.dropped),
+		"buffer_allocs":         atomic.LoadInt64(&m.bufferAllocs),
+		"accept_latency_count":  acceptCount,
+		"accept_latency_sum_ns": acceptSumNs,
+		"accept_latency_max_ns": acceptMaxNs,
+		"dial_latency_count":    dialCount,
+		"dial_latency_sum_ns":   dialSumNs,
+		"dial_latency_max_ns":   dialMaxNs,
+	}
+}
+
+func (m *ExpvarMetrics) FlowOpened()  { atomic.AddInt64(&m.activeFlows, 1) }
+func (m *ExpvarMetrics) FlowClosed()  { atomic.AddInt64(&m.activeFlows, -1) }
+func (m *ExpvarMetrics) DialFailure() { atomic.AddInt64(&m.dialFailures, 1) }
+func (m *ExpvarMetrics) IdleTimeout() { atomic.AddInt64(&m.idleTimeouts, 1) }
+
+// Dropped does not break counts down by reason, since Snapshot's shape is
+// fixed; use PrometheusMetrics if per-reason series are needed.
+func (m *ExpvarMetrics) Dropped(reason string) { atomic.AddInt64(&m.dropped, 1) }
+
+func (m *ExpvarMetrics) BufferAlloc() { atomic.AddInt64(&m.bufferAllocs, 1) }
+
+func (m *ExpvarMetrics) Packet(dir Direction, n int) {
+	switch dir {
+	case DirIn:
+		atomic.AddInt64(&m.packetsIn, 1)
+		atomic.AddInt64(&m.bytesIn, int64(n))
+	case DirOut:
+		atomic.AddInt64(&m.packetsOut, 1)
+		atomic.AddInt64(&m.bytesOut, int64(n))
+	default:
+		panic(fmt.Sprintf("unknown direction %d", dir))
+	}
+}
+
+func (m *ExpvarMetrics) AcceptLatency(d time.Duration) {
+	m.acceptLatency.Observe(d)
+}
+
+func (m *ExpvarMetrics) DialLatency(d time.Duration) {
+	m.dialLatency.Observe(d)
+}
@@ -0,0 +1,109 @@
+package portmapper
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusMetrics is a Metrics implementation for operators who already
+// run a Prometheus registry, rather than scraping expvar. Register it
+// once per process and pass it to every PortMap via PortMap.Metrics; the
+// label set identifies which mapping a sample came from.
+type PrometheusMetrics struct {
+	labels prometheus.Labels
+
+	activeFlows   prometheus.Gauge
+	packets       *prometheus.CounterVec
+	bytes         *prometheus.CounterVec
+	dialFailures  prometheus.Counter
+	idleTimeouts  prometheus.Counter
+	dropped       *prometheus.CounterVec
+	bufferAllocs  prometheus.Counter
+	acceptLatency prometheus.Histogram
+	dialLatency   prometheus.Histogram
+}
+
+// NewPrometheusMetrics registers the collectors for one portmap under reg
+// and tags every series with name (e.g. pm.Src), so a single registry can
+// serve many PortMaps.
+func NewPrometheusMetrics(reg prometheus.Registerer, name string) (m *PrometheusMetrics) {
+	labels := prometheus.Labels{"portmap": name}
+	m = &PrometheusMetrics{
+		labels: labels,
+		activeFlows: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "portmap_active_flows",
+			Help:        "Number of currently open flows.",
+			ConstLabels: labels,
+		}),
+		packets: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "portmap_packets_total",
+			Help:        "Packets processed, by direction.",
+			ConstLabels: labels,
+		}, []string{"direction"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "portmap_bytes_total",
+			Help:        "Bytes processed, by direction.",
+			ConstLabels: labels,
+		}, []string{"direction"}),
+		dialFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "portmap_dial_failures_total",
+			Help:        "Upstream dial failures.",
+			ConstLabels: labels,
+		}),
+		idleTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "portmap_idle_timeouts_total",
+			Help:        "Flows closed for exceeding their idle timeout.",
+			ConstLabels: labels,
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "portmap_dropped_total",
+			Help:        "Packets dropped by a rate or flow limit, by reason.",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		bufferAllocs: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "portmap_buffer_allocs_total",
+			Help:        "Datagram buffers allocated because none were available in the pool.",
+			ConstLabels: labels,
+		}),
+		acceptLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "portmap_accept_latency_seconds",
+			Help:        "Time from listen to accept for TCP flows.",
+			ConstLabels: labels,
+		}),
+		dialLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:        "portmap_dial_latency_seconds",
+			Help:        "Time to dial the upstream destination.",
+			ConstLabels: labels,
+		}),
+	}
+	reg.MustRegister(m.activeFlows, m.packets, m.bytes, m.dialFailures,
+		m.idleTimeouts, m.dropped, m.bufferAllocs, m.acceptLatency, m.dialLatency)
+	return
+}
+
+func (m *PrometheusMetrics) FlowOpened()  { m.activeFlows.Inc() }
+func (m *PrometheusMetrics) FlowClosed()  { m.activeFlows.Dec() }
+func (m *PrometheusMetrics) DialFailure() { m.dialFailures.Inc() }
+func (m *PrometheusMetrics) IdleTimeout() { m.idleTimeouts.Inc() }
+
+func (m *PrometheusMetrics) Dropped(reason string) { m.dropped.WithLabelValues(reason).Inc() }
+
+func (m *PrometheusMetrics) BufferAlloc() { m.bufferAllocs.Inc() }
+
+func (m *PrometheusMetrics) Packet(dir Direction, n int) {
+	label := "in"
+	if dir == DirOut {
+		label = "out"
+	}
+	m.packets.WithLabelValues(label).Inc()
+	m.bytes.WithLabelValues(label).Add(float64(n))
+}
+
+func (m *PrometheusMetrics) AcceptLatency(d time.Duration) {
+	m.acceptLatency.Observe(d.Seconds())
+}
+
+func (m *PrometheusMetrics) DialLatency(d time.Duration) {
+	m.dialLatency.Observe(d.Seconds())
+}
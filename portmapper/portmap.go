@@ -1,40 +1,133 @@
 package portmapper
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	logging "github.com/op/go-logging"
+	"github.com/pion/dtls/v2"
 	"github.com/shell909090/goproxy/netutil"
 )
 
 var logger = logging.MustGetLogger("portmap")
 
+// errDropped is returned by getOrDial when a packet was deliberately
+// discarded by a rate or flow limit rather than failing. UdpPortmap
+// treats it as routine, not an error worth logging.
+var errDropped = errors.New("portmap: dropped by limit")
+
 const (
-	UDP_TICK           = 60
-	UDP_TIMEOUT        = 5
 	UDP_BLOCK_INTERVAL = 500
 	UDP_READBUFFER     = 1048576
+	// UDP_IDLE_TIMEOUT is the default idle timeout for a UdpMapperConn
+	// when PortMap.IdleTimeout is left zero.
+	UDP_IDLE_TIMEOUT = 5 * time.Minute
+	// DefaultMaxDatagramSize is the datagram buffer size used when
+	// PortMap.MaxDatagramSize is left zero. It's large enough to hold a
+	// maximum-size UDP datagram, unlike the 8 KiB buffer this replaces.
+	DefaultMaxDatagramSize = 65535
 )
 
 type PortMap struct {
 	Net string
 	Src string
 	Dst string
+
+	// Mode selects how client flows are mapped onto upstream
+	// connections. Defaults to SymmetricNAT.
+	Mode NATMode
+	// Demuxer is required when Mode is EndpointIndependent: it encodes
+	// the client address onto outgoing packets and decodes it back out
+	// of incoming ones so a single shared dconn can serve every source.
+	Demuxer Demuxer
+
+	// IdleTimeout is how long a UDP flow may go without traffic before
+	// it's torn down. Defaults to UDP_IDLE_TIMEOUT when zero.
+	IdleTimeout time.Duration
+
+	// Metrics and Hooks are optional observability integrations. Both
+	// default to no-ops, so existing callers see no behaviour change.
+	Metrics Metrics
+	Hooks   EventHook
+
+	// MaxFlows caps the number of concurrent UDP flows this mapping will
+	// open. Zero means unlimited.
+	MaxFlows int
+	// MaxFlowsPerSourceIP caps concurrent flows per source IP, to limit
+	// how much of MaxFlows a single abusive source can claim. Zero means
+	// unlimited.
+	MaxFlowsPerSourceIP int
+	// PacketsPerSecondPerFlow token-bucket limits inbound packets per
+	// flow. Zero means unlimited.
+	PacketsPerSecondPerFlow int
+	// AllowSource, if set, is consulted before opening a new flow; a
+	// false return drops the packet that would have opened it.
+	AllowSource func(net.Addr) bool
+	// BlockInterval is the cooldown after a failed dial to Dst during
+	// which new flows to that destination are dropped instead of
+	// retried. Defaults to UDP_BLOCK_INTERVAL milliseconds when zero.
+	BlockInterval time.Duration
+
+	// ReadBufferBytes sets the listening UDP socket's kernel receive
+	// buffer (SO_RCVBUF). Defaults to UDP_READBUFFER when zero.
+	ReadBufferBytes int
+	// MaxDatagramSize bounds the size of a single UDP datagram buffer,
+	// used for both directions of a flow. Defaults to
+	// DefaultMaxDatagramSize when zero.
+	MaxDatagramSize int
+
+	// ListenTLS, if set, terminates TLS on the listen side of a TCP
+	// mapping: Accept hands TcpPortmap already-handshaken connections.
+	ListenTLS *tls.Config
+	// DialTLS, if set, originates TLS to Dst for a TCP mapping, wrapping
+	// the plain connection the configured Dialer returns.
+	DialTLS *tls.Config
+	// ListenDTLS, if set, terminates DTLS on the listen side of a UDP
+	// mapping. Each flow gets its own DTLS session, with the server
+	// handshake driven off the first inbound packet from that source.
+	// Not supported together with Mode == EndpointIndependent, since
+	// that mode shares one upstream conn across every source.
+	ListenDTLS *dtls.Config
+	// DialDTLS, if set, originates DTLS to Dst for a UDP mapping,
+	// wrapping the plain connection the configured Dialer returns.
+	DialDTLS *dtls.Config
+
+	// ProxyProtocol controls whether TcpPortmap writes a PROXY protocol
+	// header to dconn before proxying begins, so the backend sees
+	// sconn's true client address instead of this process's.
+	ProxyProtocol ProxyProtocolMode
+	// ProxyProtocolInbound, if true, expects a PROXY protocol header at
+	// the front of sconn and strips it before forwarding, treating its
+	// reported address as the true client address. Use this to chain a
+	// mapping behind another PROXY-protocol-speaking load balancer.
+	ProxyProtocolInbound bool
 }
 
 type UdpPortMapper struct {
-	lock  sync.Mutex
-	ports map[net.Addr]*UdpMapperConn
+	lock     sync.Mutex
+	ports    map[net.Addr]*UdpMapperConn
+	shared   map[string]*UdpMapperConn
+	srcFlows map[string]int
+	blocked  map[string]time.Time
+	numFlows int
+
+	// bufPool is set up by UdpPortmap before its read loop starts, sized
+	// to the PortMap's MaxDatagramSize.
+	bufPool *bufferPool
 }
 
 func NewUdpPortMapper() (upm *UdpPortMapper) {
 	upm = &UdpPortMapper{
-		ports: make(map[net.Addr]*UdpMapperConn, 0),
+		ports:    make(map[net.Addr]*UdpMapperConn, 0),
+		shared:   make(map[string]*UdpMapperConn, 0),
+		srcFlows: make(map[string]int, 0),
+		blocked:  make(map[string]time.Time, 0),
 	}
 	return
 }
@@ -53,7 +146,22 @@ func (upm *UdpPortMapper) RemovePorts(addr net.Addr) {
 	return
 }
 
+// removeShared drops a shared (EndpointIndependent) conn keyed by dst.
+func (upm *UdpPortMapper) removeShared(dst string) {
+	upm.lock.Lock()
+	defer upm.lock.Unlock()
+	delete(upm.shared, dst)
+	logger.Debug("remove shared port %s.", dst)
+}
+
 func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+	if pm.Mode == EndpointIndependent && pm.Demuxer == nil {
+		return errors.New("portmap: EndpointIndependent mode requires a Demuxer")
+	}
+	if pm.Mode == EndpointIndependent && pm.ListenDTLS != nil {
+		return errors.New("portmap: ListenDTLS is not supported with EndpointIndependent mode")
+	}
+
 	laddr, err := net.ResolveUDPAddr(pm.Net, pm.Src)
 	if err != nil {
 		return
@@ -63,11 +171,21 @@ func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err err
 		return
 	}
 	defer sconn.Close()
-	sconn.SetReadBuffer(UDP_READBUFFER)
+	readBuffer := pm.ReadBufferBytes
+	if readBuffer <= 0 {
+		readBuffer = UDP_READBUFFER
+	}
+	sconn.SetReadBuffer(readBuffer)
 	logger.Info("udp listening in %s", pm.Src)
 
+	datagramSize := pm.MaxDatagramSize
+	if datagramSize <= 0 {
+		datagramSize = DefaultMaxDatagramSize
+	}
+	upm.bufPool = newBufferPool(datagramSize, metricsOf(pm))
+
 	for {
-		up := NewUdpPackage()
+		up := NewUdpPackage(upm.bufPool)
 		nr, addr, err := sconn.ReadFrom(up.buf)
 		switch err {
 		case nil:
@@ -78,104 +196,318 @@ func (upm *UdpPortMapper) UdpPortmap(pm PortMap, dialer netutil.Dialer) (err err
 			continue
 		}
 		up.nr = nr
+		up.addr = addr
 
-		upm.lock.Lock()
-		umc, ok := upm.ports[addr]
-		if !ok {
-			logger.Info("udp forward got new addr %s.", addr)
-			dconn, err := dialer.Dial(pm.Net, pm.Dst)
-			if err != nil {
-				upm.lock.Unlock()
+		umc, err := upm.getOrDial(pm, dialer, sconn, addr)
+		if err != nil {
+			if err != errDropped {
 				logger.Error("%s", err.Error())
-				continue
 			}
-			umc = NewUdpMapperConn(upm, sconn, dconn, addr, pm.Dst)
-			upm.ports[addr] = umc
-			umc.Run()
+			up.Free()
+			continue
+		}
+
+		if umc.limiter != nil && !umc.limiter.Allow() {
+			umc.metrics.Dropped("rate_limit")
+			up.Free()
+			continue
 		}
-		upm.lock.Unlock()
 
 		umc.ch <- up
 	}
 }
 
+// getOrDial returns the UdpMapperConn responsible for addr, dialing (and
+// registering) a new one if needed. In EndpointIndependent mode, a single
+// conn dialed to pm.Dst is shared across every source.
+func (upm *UdpPortMapper) getOrDial(pm PortMap, dialer netutil.Dialer,
+	sconn *net.UDPConn, addr net.Addr) (umc *UdpMapperConn, err error) {
+	upm.lock.Lock()
+	defer upm.lock.Unlock()
+
+	metrics := metricsOf(pm)
+
+	if pm.Mode == EndpointIndependent {
+		// checkSource is consulted on every packet, not just when the
+		// shared conn is first dialed: it's the only thing standing
+		// between AllowSource/MaxFlowsPerSourceIP and a source that
+		// joins a dst every other source already shares.
+		if !upm.checkSource(pm, addr, metrics) {
+			return nil, errDropped
+		}
+		if umc, ok := upm.shared[pm.Dst]; ok {
+			return umc, nil
+		}
+		if upm.isBlocked(pm) {
+			metrics.Dropped("blocked")
+			return nil, errDropped
+		}
+		logger.Info("udp forward dialing shared conn to %s.", pm.Dst)
+		dconn, err := dialUpstream(pm, dialer)
+		if err != nil {
+			upm.blockDst(pm)
+			metrics.DialFailure()
+			return nil, err
+		}
+		umc = NewUdpMapperConn(upm, pm, sconn, dconn, addr)
+		umc.demux = pm.Demuxer
+		umc.shared = true
+		upm.shared[pm.Dst] = umc
+		umc.Run()
+		return umc, nil
+	}
+
+	umc, ok := upm.ports[addr]
+	if ok {
+		return umc, nil
+	}
+	if !upm.checkSource(pm, addr, metrics) {
+		return nil, errDropped
+	}
+	if upm.isBlocked(pm) {
+		metrics.Dropped("blocked")
+		return nil, errDropped
+	}
+	if !upm.reserveFlow(pm, addr, metrics) {
+		return nil, errDropped
+	}
+	logger.Info("udp forward got new addr %s.", addr)
+	dconn, err := dialUpstream(pm, dialer)
+	if err != nil {
+		upm.releaseFlow(addr)
+		upm.blockDst(pm)
+		metrics.DialFailure()
+		return nil, err
+	}
+	umc = NewUdpMapperConn(upm, pm, sconn, dconn, addr)
+	upm.ports[addr] = umc
+	umc.Run()
+	return umc, nil
+}
+
+// dialUpstream dials pm.Dst and, if pm.DialDTLS is set, originates a DTLS
+// session over the resulting connection.
+func dialUpstream(pm PortMap, dialer netutil.Dialer) (dconn net.Conn, err error) {
+	dconn, err = dialer.Dial(pm.Net, pm.Dst)
+	if err != nil {
+		return nil, err
+	}
+	if pm.DialDTLS != nil {
+		dconn, err = dtls.Client(dconn, pm.DialDTLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dconn, nil
+}
+
+// checkSource reports whether addr may open a new flow under pm.AllowSource
+// and pm.MaxFlowsPerSourceIP, without reserving anything. Must be called
+// with upm.lock held.
+func (upm *UdpPortMapper) checkSource(pm PortMap, addr net.Addr, metrics Metrics) bool {
+	if pm.AllowSource != nil && !pm.AllowSource(addr) {
+		metrics.Dropped("disallowed")
+		return false
+	}
+	if pm.MaxFlowsPerSourceIP > 0 && upm.srcFlows[srcKey(addr)] >= pm.MaxFlowsPerSourceIP {
+		metrics.Dropped("max_flows_per_source")
+		return false
+	}
+	return true
+}
+
+// reserveFlow enforces pm.MaxFlows and reserves a slot for addr's source
+// IP on success. Must be called with upm.lock held; pairs with releaseFlow.
+func (upm *UdpPortMapper) reserveFlow(pm PortMap, addr net.Addr, metrics Metrics) bool {
+	if pm.MaxFlows > 0 && upm.numFlows >= pm.MaxFlows {
+		metrics.Dropped("max_flows")
+		return false
+	}
+	upm.numFlows++
+	upm.srcFlows[srcKey(addr)]++
+	return true
+}
+
+// releaseFlow undoes a reserveFlow, whether the flow was ever opened or the
+// subsequent dial failed.
+func (upm *UdpPortMapper) releaseFlow(addr net.Addr) {
+	upm.numFlows--
+	key := srcKey(addr)
+	upm.srcFlows[key]--
+	if upm.srcFlows[key] <= 0 {
+		delete(upm.srcFlows, key)
+	}
+}
+
+// isBlocked reports whether pm.Dst is still in its post-dial-failure
+// cooldown. Must be called with upm.lock held.
+func (upm *UdpPortMapper) isBlocked(pm PortMap) bool {
+	until, ok := upm.blocked[pm.Dst]
+	return ok && time.Now().Before(until)
+}
+
+// blockDst starts (or restarts) the dial-failure cooldown for pm.Dst.
+func (upm *UdpPortMapper) blockDst(pm PortMap) {
+	interval := pm.BlockInterval
+	if interval <= 0 {
+		interval = UDP_BLOCK_INTERVAL * time.Millisecond
+	}
+	upm.blocked[pm.Dst] = time.Now().Add(interval)
+}
+
+// srcKey extracts the host part of addr, so flow limits are tracked per
+// source IP rather than per source port.
+func srcKey(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
 type UdpPackage struct {
-	buf []byte
-	nr  int
+	buf  []byte
+	nr   int
+	addr net.Addr
+	pool *bufferPool
 }
 
-func NewUdpPackage() (up *UdpPackage) {
+func NewUdpPackage(pool *bufferPool) (up *UdpPackage) {
 	up = &UdpPackage{
-		buf: allocbuf(),
+		buf:  pool.Get(),
+		pool: pool,
 	}
 	return
 }
 
 func (up *UdpPackage) Free() {
-	freebuf(up.buf)
+	up.pool.Put(up.buf)
 }
 
 type UdpMapperConn struct {
-	upm   *UdpPortMapper
-	tick  <-chan time.Time
-	cnt   int32
-	sconn *net.UDPConn
-	dconn net.Conn
-	addr  net.Addr
-	dst   string
-	ch    chan *UdpPackage
+	upm         *UdpPortMapper
+	pm          PortMap
+	ctx         context.Context
+	cancel      context.CancelFunc
+	idleTimeout time.Duration
+	sconn       *net.UDPConn
+	dconn       net.Conn
+	addr        net.Addr
+	dst         string
+	ch          chan *UdpPackage
+	pool        *bufferPool
+
+	metrics Metrics
+	hooks   EventHook
+
+	// limiter is non-nil when pm.PacketsPerSecondPerFlow is set; it caps
+	// the rate at which inbound packets are forwarded through this flow.
+	limiter *tokenBucket
+
+	// shared and demux are set when this conn is running in
+	// EndpointIndependent mode, where dconn is fanned out across
+	// multiple client addresses instead of owning exactly one.
+	shared bool
+	demux  Demuxer
 }
 
-func NewUdpMapperConn(upm *UdpPortMapper, sconn *net.UDPConn,
-	dconn net.Conn, addr net.Addr, dst string) (umc *UdpMapperConn) {
+func NewUdpMapperConn(upm *UdpPortMapper, pm PortMap, sconn *net.UDPConn,
+	dconn net.Conn, addr net.Addr) (umc *UdpMapperConn) {
+	idleTimeout := pm.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = UDP_IDLE_TIMEOUT
+	}
+	ctx, cancel := context.WithCancel(context.Background())
 	umc = &UdpMapperConn{
-		upm:   upm,
-		tick:  time.Tick(UDP_TICK * time.Second),
-		sconn: sconn,
-		dconn: dconn,
-		addr:  addr,
-		dst:   dst,
-		ch:    make(chan *UdpPackage, 0),
+		upm:         upm,
+		pm:          pm,
+		ctx:         ctx,
+		cancel:      cancel,
+		idleTimeout: idleTimeout,
+		sconn:       sconn,
+		dconn:       dconn,
+		addr:        addr,
+		dst:         pm.Dst,
+		ch:          make(chan *UdpPackage, 0),
+		pool:        upm.bufPool,
+		metrics:     metricsOf(pm),
+		hooks:       hooksOf(pm),
+	}
+	if pm.PacketsPerSecondPerFlow > 0 {
+		umc.limiter = newTokenBucket(pm.PacketsPerSecondPerFlow)
 	}
+	umc.metrics.FlowOpened()
+	umc.hooks.OnFlowOpen(pm, addr)
 	return
 }
 
 func (umc *UdpMapperConn) Close() {
-	logger.Notice("udp redirect %s closed.", umc.addr.String())
+	umc.closeReason("closed")
+}
+
+func (umc *UdpMapperConn) closeReason(reason string) {
+	logger.Notice("udp redirect %s closed: %s.", umc.addr.String(), reason)
+	umc.cancel()
 	umc.dconn.Close()
 	close(umc.ch)
-	umc.upm.RemovePorts(umc.addr)
+	umc.metrics.FlowClosed()
+	umc.hooks.OnFlowClose(umc.pm, umc.addr, reason)
+	if umc.shared {
+		umc.upm.removeShared(umc.dst)
+	} else {
+		umc.upm.RemovePorts(umc.addr)
+		umc.upm.lock.Lock()
+		umc.upm.releaseFlow(umc.addr)
+		umc.upm.lock.Unlock()
+	}
 	return
 }
 
 func (umc *UdpMapperConn) Run() {
+	if umc.pm.ListenDTLS != nil && !umc.shared {
+		go umc.runDTLS()
+		return
+	}
 	go umc.SendHandler()
 	go umc.RecvHandler()
-	go func() {
-		for _ = range umc.tick {
-			if atomic.AddInt32(&umc.cnt, 1) >= UDP_TIMEOUT {
-				umc.Close()
-				return
-			}
-		}
-	}()
 }
 
 func (umc *UdpMapperConn) RecvHandler() {
-	var buf [8192]byte
+	buf := umc.pool.Get()
+	defer umc.pool.Put(buf)
 	defer umc.dconn.Close()
 	for {
-		nr, err := umc.dconn.Read(buf[:])
-		switch err {
+		umc.dconn.SetReadDeadline(time.Now().Add(umc.idleTimeout))
+		nr, err := umc.dconn.Read(buf)
+		switch e := err.(type) {
 		case nil:
-		case io.EOF:
-			return
+		case net.Error:
+			if e.Timeout() {
+				umc.metrics.IdleTimeout()
+				umc.closeReason("idle timeout")
+				return
+			}
+			logger.Error("%s", err.Error())
+			continue
 		default:
+			if err == io.EOF {
+				return
+			}
 			logger.Error("%s", err.Error())
 			continue
 		}
 
-		_, err = umc.sconn.WriteTo(buf[0:nr], umc.addr)
+		addr := umc.addr
+		payload := buf[0:nr]
+		if umc.shared {
+			addr, payload, err = umc.demux.Decode(payload)
+			if err != nil {
+				logger.Error("%s", err.Error())
+				continue
+			}
+		}
+
+		_, err = umc.sconn.WriteTo(payload, addr)
 		switch err {
 		case nil:
 		case io.EOF:
@@ -185,36 +517,54 @@ func (umc *UdpMapperConn) RecvHandler() {
 			continue
 		}
 
-		atomic.StoreInt32(&umc.cnt, 0)
-		logger.Debug("udp package recved %s <=> %s.", umc.addr.String(), umc.dst)
+		umc.metrics.Packet(DirIn, len(payload))
+		umc.hooks.OnPacket(DirIn, len(payload))
+		logger.Debug("udp package recved %s <=> %s.", addr.String(), umc.dst)
 	}
 }
 
 func (umc *UdpMapperConn) SendHandler() {
 	defer umc.dconn.Close()
 	for {
-		up, ok := <-umc.ch
-		if !ok {
+		select {
+		case <-umc.ctx.Done():
 			return
-		}
+		case up, ok := <-umc.ch:
+			if !ok {
+				return
+			}
 
-		_, err := umc.dconn.Write(up.buf[0:up.nr])
-		switch err {
-		case nil:
-		case io.EOF:
-			return
-		default:
-			logger.Error("%s", err.Error())
-			continue
-		}
-		up.Free()
+			payload := up.buf[0:up.nr]
+			if umc.shared {
+				payload = umc.demux.Encode(up.addr, payload)
+			}
+
+			_, err := umc.dconn.Write(payload)
+			switch err {
+			case nil:
+			case io.EOF:
+				return
+			default:
+				logger.Error("%s", err.Error())
+				continue
+			}
+			up.Free()
 
-		atomic.StoreInt32(&umc.cnt, 0)
-		logger.Debug("udp package sent %s <=> %s.", umc.addr.String(), umc.dst)
+			umc.metrics.Packet(DirOut, len(payload))
+			umc.hooks.OnPacket(DirOut, len(payload))
+			logger.Debug("udp package sent %s <=> %s.", up.addr.String(), umc.dst)
+		}
 	}
 }
 
 func TcpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+	metrics := metricsOf(pm)
+	hooks := hooksOf(pm)
+
+	// lsock stays a plain listener, even under ListenTLS: pm.ProxyProtocolInbound
+	// needs the raw bytes to strip a PROXY header before any TLS ClientHello
+	// on the same connection reaches the TLS layer, so TLS is wrapped per
+	// accepted conn below instead of via tls.NewListener.
 	lsock, err := net.Listen(pm.Net, pm.Src)
 	if err != nil {
 		return
@@ -222,22 +572,79 @@ func TcpPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
 	logger.Infof("tcp listening in %s", pm.Src)
 
 	for {
-		var sconn, dconn net.Conn
-
-		sconn, err = lsock.Accept()
+		listenStart := time.Now()
+		sconn, err := lsock.Accept()
 		if err != nil {
 			continue
 		}
-		logger.Infof("accept in %s:%s, try to dial %s.", pm.Net, pm.Src, pm.Dst)
+		go handleTcpConn(pm, dialer, metrics, hooks, sconn, listenStart)
+	}
+}
 
-		dconn, err = dialer.Dial(pm.Net, pm.Dst)
+// handleTcpConn carries one accepted connection through PROXY header
+// parsing, TLS handshake, upstream dial, and the bridge itself. It runs in
+// its own goroutine per conn so a slow or stalled client (e.g. one that
+// never completes a handshake) can't block lsock.Accept() from serving
+// everyone else.
+func handleTcpConn(pm PortMap, dialer netutil.Dialer, metrics Metrics, hooks EventHook,
+	sconn net.Conn, listenStart time.Time) {
+	clientAddr := sconn.RemoteAddr()
+
+	if pm.ProxyProtocolInbound {
+		raw := sconn
+		var proxyAddr net.Addr
+		var err error
+		sconn, proxyAddr, err = readProxyHeader(raw)
 		if err != nil {
+			logger.Error("%s", err.Error())
+			raw.Close()
+			return
+		}
+		if proxyAddr != nil {
+			clientAddr = proxyAddr
+		}
+	}
+
+	var sni string
+	if pm.ListenTLS != nil {
+		tconn := tls.Server(sconn, pm.ListenTLS)
+		if err := tconn.Handshake(); err != nil {
+			logger.Error("%s", err.Error())
 			sconn.Close()
-			continue
+			return
 		}
+		sni = tconn.ConnectionState().ServerName
+		sconn = tconn
+	}
+	metrics.AcceptLatency(time.Since(listenStart))
+	logger.Infof("accept in %s:%s, try to dial %s.", pm.Net, pm.Src, pm.Dst)
 
-		go netutil.CopyLink(dconn, sconn)
+	dialStart := time.Now()
+	dconn, err := dialer.Dial(pm.Net, pm.Dst)
+	if err != nil {
+		metrics.DialFailure()
+		sconn.Close()
+		return
 	}
+	if pm.ProxyProtocol != ProxyProtocolOff {
+		if err = writeProxyHeader(dconn, pm, clientAddr, sconn.LocalAddr(), sni); err != nil {
+			logger.Error("%s", err.Error())
+			metrics.DialFailure()
+			dconn.Close()
+			sconn.Close()
+			return
+		}
+	}
+	if pm.DialTLS != nil {
+		dconn = tls.Client(dconn, pm.DialTLS)
+	}
+	metrics.DialLatency(time.Since(dialStart))
+
+	metrics.FlowOpened()
+	hooks.OnFlowOpen(pm, clientAddr)
+	netutil.CopyLink(dconn, sconn)
+	metrics.FlowClosed()
+	hooks.OnFlowClose(pm, clientAddr, "closed")
 }
 
 func CreatePortmap(pm PortMap, dialer netutil.Dialer) {
@@ -257,6 +664,20 @@ func CreatePortmap(pm PortMap, dialer netutil.Dialer) {
 				logger.Error("%s", err.Error())
 			}
 		}()
+	case pm.Net == "unixgram":
+		go func() {
+			err := UnixgramPortmap(pm, dialer)
+			if err != nil {
+				logger.Error("%s", err.Error())
+			}
+		}()
+	case pm.Net == "unix":
+		go func() {
+			err := UnixPortmap(pm, dialer)
+			if err != nil {
+				logger.Error("%s", err.Error())
+			}
+		}()
 	}
 	return
 }
@@ -0,0 +1,226 @@
+package portmapper
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// ProxyProtocolMode selects whether, and in which version, TcpPortmap
+// writes an HAProxy PROXY protocol header to dconn before proxying
+// begins, so the backend can see the real client address instead of
+// this process's.
+type ProxyProtocolMode int
+
+const (
+	ProxyProtocolOff ProxyProtocolMode = iota
+	ProxyProtocolV1
+	ProxyProtocolV2
+)
+
+var proxyProtocolV2Signature = [12]byte{
+	0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+}
+
+const (
+	pp2TypeAuthority byte = 0x02
+	pp2TypeUniqueID  byte = 0x05
+)
+
+// writeProxyHeader writes a PROXY protocol header describing the src/dst
+// pair to w, in the version pm.ProxyProtocol selects. sni, when non-empty,
+// is carried in a PP2_TYPE_AUTHORITY TLV; it's only meaningful for v2.
+func writeProxyHeader(w io.Writer, pm PortMap, src, dst net.Addr, sni string) (err error) {
+	switch pm.ProxyProtocol {
+	case ProxyProtocolOff:
+		return nil
+	case ProxyProtocolV1:
+		return writeProxyHeaderV1(w, src, dst)
+	case ProxyProtocolV2:
+		return writeProxyHeaderV2(w, src, dst, sni)
+	default:
+		return fmt.Errorf("portmap: unknown ProxyProtocol mode %d", pm.ProxyProtocol)
+	}
+}
+
+func writeProxyHeaderV1(w io.Writer, src, dst net.Addr) (err error) {
+	srcHost, srcPort, err := hostPort(src)
+	if err != nil {
+		return err
+	}
+	dstHost, dstPort, err := hostPort(dst)
+	if err != nil {
+		return err
+	}
+	family := "TCP4"
+	if strings.Contains(srcHost, ":") {
+		family = "TCP6"
+	}
+	_, err = fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", family, srcHost, dstHost, srcPort, dstPort)
+	return err
+}
+
+func writeProxyHeaderV2(w io.Writer, src, dst net.Addr, sni string) (err error) {
+	srcHost, srcPort, err := hostPort(src)
+	if err != nil {
+		return err
+	}
+	dstHost, dstPort, err := hostPort(dst)
+	if err != nil {
+		return err
+	}
+	srcIP, dstIP := net.ParseIP(srcHost), net.ParseIP(dstHost)
+
+	var famProto byte
+	var addrBlock []byte
+	if v4 := srcIP.To4(); v4 != nil {
+		famProto = 0x11 // AF_INET, STREAM
+		addrBlock = make([]byte, 12)
+		copy(addrBlock[0:4], v4)
+		copy(addrBlock[4:8], dstIP.To4())
+		binary.BigEndian.PutUint16(addrBlock[8:10], uint16(srcPort))
+		binary.BigEndian.PutUint16(addrBlock[10:12], uint16(dstPort))
+	} else {
+		famProto = 0x21 // AF_INET6, STREAM
+		addrBlock = make([]byte, 36)
+		copy(addrBlock[0:16], srcIP.To16())
+		copy(addrBlock[16:32], dstIP.To16())
+		binary.BigEndian.PutUint16(addrBlock[32:34], uint16(srcPort))
+		binary.BigEndian.PutUint16(addrBlock[34:36], uint16(dstPort))
+	}
+
+	var tlvs []byte
+	if sni != "" {
+		tlvs = append(tlvs, encodeProxyTLV(pp2TypeAuthority, []byte(sni))...)
+	}
+	if id, err := uuid.New().MarshalBinary(); err == nil {
+		tlvs = append(tlvs, encodeProxyTLV(pp2TypeUniqueID, id)...)
+	}
+
+	header := make([]byte, 0, len(proxyProtocolV2Signature)+4+len(addrBlock)+len(tlvs))
+	header = append(header, proxyProtocolV2Signature[:]...)
+	header = append(header, 0x21) // version 2, command PROXY
+	header = append(header, famProto)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrBlock)+len(tlvs)))
+	header = append(header, length...)
+	header = append(header, addrBlock...)
+	header = append(header, tlvs...)
+
+	_, err = w.Write(header)
+	return err
+}
+
+func encodeProxyTLV(t byte, v []byte) []byte {
+	buf := make([]byte, 3+len(v))
+	buf[0] = t
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(v)))
+	copy(buf[3:], v)
+	return buf
+}
+
+func hostPort(addr net.Addr) (host string, port int, err error) {
+	h, p, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return "", 0, err
+	}
+	port, err = strconv.Atoi(p)
+	return h, port, err
+}
+
+// proxyHeaderConn is sconn once its leading PROXY protocol header has been
+// consumed: Read resumes from the buffered reader positioned right after
+// the header, so nothing the client sent gets lost or re-parsed.
+type proxyHeaderConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *proxyHeaderConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// readProxyHeader parses and strips a PROXY protocol v1 or v2 header from
+// the front of conn, returning a conn to keep reading from and the client
+// address the header reported. addr is nil for a v1 "UNKNOWN" header or a
+// v2 LOCAL command, meaning conn.RemoteAddr() should keep being trusted.
+func readProxyHeader(conn net.Conn) (out net.Conn, addr net.Addr, err error) {
+	br := bufio.NewReader(conn)
+	peek, err := br.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch {
+	case string(peek) == string(proxyProtocolV2Signature[:]):
+		addr, err = parseProxyHeaderV2(br)
+	case strings.HasPrefix(string(peek), "PROXY "):
+		addr, err = parseProxyHeaderV1(br)
+	default:
+		return nil, nil, errors.New("portmap: no PROXY protocol header present")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &proxyHeaderConn{Conn: conn, r: br}, addr, nil
+}
+
+func parseProxyHeaderV1(br *bufio.Reader) (addr net.Addr, err error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("portmap: malformed PROXY protocol v1 header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("portmap: malformed PROXY protocol v1 header %q", line)
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: port}, nil
+}
+
+func parseProxyHeaderV2(br *bufio.Reader) (addr net.Addr, err error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err = io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	famProto := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+	body := make([]byte, length)
+	if _, err = io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+
+	switch famProto >> 4 {
+	case 0x1: // AF_INET
+		if len(body) < 10 {
+			return nil, errors.New("portmap: short PROXY protocol v2 IPv4 address block")
+		}
+		port := binary.BigEndian.Uint16(body[8:10])
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(port)}, nil
+	case 0x2: // AF_INET6
+		if len(body) < 34 {
+			return nil, errors.New("portmap: short PROXY protocol v2 IPv6 address block")
+		}
+		port := binary.BigEndian.Uint16(body[32:34])
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(port)}, nil
+	default:
+		// UNSPEC/LOCAL: no address carried, keep trusting conn.RemoteAddr().
+		return nil, nil
+	}
+}
@@ -0,0 +1,44 @@
+package portmapper
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token-bucket rate limiter used to cap the
+// packet rate a single UdpMapperConn will forward. ratePerSecond also
+// doubles as the bucket's burst capacity.
+type tokenBucket struct {
+	lock       sync.Mutex
+	ratePerSec float64
+	tokens     float64
+	last       time.Time
+}
+
+func newTokenBucket(ratePerSecond int) *tokenBucket {
+	return &tokenBucket{
+		ratePerSec: float64(ratePerSecond),
+		tokens:     float64(ratePerSecond),
+		last:       time.Now(),
+	}
+}
+
+// Allow reports whether a packet may be forwarded now, consuming a token
+// if so.
+func (b *tokenBucket) Allow() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.ratePerSec
+	if b.tokens > b.ratePerSec {
+		b.tokens = b.ratePerSec
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
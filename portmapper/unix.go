@@ -0,0 +1,122 @@
+package portmapper
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/shell909090/goproxy/netutil"
+)
+
+// cleanupUnixSocket removes a stale socket file left behind by a previous
+// listener, since net.Listen/net.ListenUnixgram refuse to bind over an
+// existing path.
+func cleanupUnixSocket(network, laddr string) {
+	switch network {
+	case "unix", "unixgram":
+		os.Remove(laddr)
+	}
+}
+
+// UnixPortmap bridges a "unix" (stream) listener to pm.Dst. net.Listen and
+// netutil.Dialer already speak the "unix" network natively, so this is
+// TcpPortmap plus the socket-file bookkeeping TCP never needed.
+func UnixPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+	cleanupUnixSocket(pm.Net, pm.Src)
+	defer os.Remove(pm.Src)
+	return TcpPortmap(pm, dialer)
+}
+
+// UnixgramPortmap is the unixgram analogue of UdpPortMapper.UdpPortmap. It
+// can't reuse that code directly because net.UnixConn.ReadFrom hands back
+// a *net.UnixAddr rather than the *net.UDPAddr UdpMapperConn is built
+// around, so the per-source dial/bridge loop is duplicated here against
+// *net.UnixConn instead.
+func UnixgramPortmap(pm PortMap, dialer netutil.Dialer) (err error) {
+	cleanupUnixSocket(pm.Net, pm.Src)
+	defer os.Remove(pm.Src)
+
+	laddr, err := net.ResolveUnixAddr(pm.Net, pm.Src)
+	if err != nil {
+		return
+	}
+	sconn, err := net.ListenUnixgram(pm.Net, laddr)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	logger.Info("unixgram listening in %s", pm.Src)
+
+	conns := make(map[string]net.Conn, 0)
+	var lock = &sync.Mutex{}
+
+	buf := make([]byte, UDP_READBUFFER)
+	for {
+		nr, addr, err := sconn.ReadFromUnix(buf)
+		switch err {
+		case nil:
+		case io.EOF:
+			return nil
+		default:
+			logger.Error("%s", err.Error())
+			continue
+		}
+		key := addr.String()
+
+		lock.Lock()
+		dconn, ok := conns[key]
+		if !ok {
+			logger.Info("unixgram forward got new addr %s.", key)
+			dconn, err = dialer.Dial(pm.Net, pm.Dst)
+			if err != nil {
+				lock.Unlock()
+				logger.Error("%s", err.Error())
+				continue
+			}
+			conns[key] = dconn
+			go unixgramRecvLoop(sconn, dconn, addr, lock, conns, key)
+		}
+		lock.Unlock()
+
+		_, err = dconn.Write(buf[0:nr])
+		if err != nil {
+			logger.Error("%s", err.Error())
+		}
+	}
+}
+
+// unixgramRecvLoop copies replies from dconn back to addr over sconn,
+// mirroring UdpMapperConn.RecvHandler for the unixgram backend case.
+func unixgramRecvLoop(sconn *net.UnixConn, dconn net.Conn, addr *net.UnixAddr,
+	lock *sync.Mutex, conns map[string]net.Conn, key string) {
+	defer func() {
+		dconn.Close()
+		lock.Lock()
+		delete(conns, key)
+		lock.Unlock()
+	}()
+
+	buf := make([]byte, UDP_READBUFFER)
+	for {
+		nr, err := dconn.Read(buf)
+		switch err {
+		case nil:
+		case io.EOF:
+			return
+		default:
+			logger.Error("%s", err.Error())
+			continue
+		}
+
+		_, err = sconn.WriteToUnix(buf[0:nr], addr)
+		switch err {
+		case nil:
+		case io.EOF:
+			return
+		default:
+			logger.Error("%s", err.Error())
+			continue
+		}
+	}
+}